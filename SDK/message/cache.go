@@ -0,0 +1,294 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// defaultImageKeyCacheSize matches the hardcoded size the previous
+// process-local LruCache used.
+const defaultImageKeyCacheSize = 1000000
+
+// defaultImageKeyCacheTTL is used for tenants with no override set via
+// SetTenantImageKeyCacheTTL.
+const defaultImageKeyCacheTTL = 7 * 24 * time.Hour
+
+// negativeCacheBaseTTL/negativeCacheMaxTTL bound the exponential backoff
+// applied to repeated upload failures for the same content hash, so a
+// broken URL/path doesn't hammer the open-platform API on every call.
+const (
+	negativeCacheBaseTTL = 30 * time.Second
+	negativeCacheMaxTTL  = 30 * time.Minute
+)
+
+// ImageKeyCache abstracts the storage backend behind GetImageKey's lookup
+// cache. Implementations are keyed by the SHA-256 hex digest of the image
+// content (see contentCacheKey), so identical images served from different
+// paths/URLs dedupe. A stored empty imageKey records a recent upload
+// failure (negative cache).
+type ImageKeyCache interface {
+	Get(ctx context.Context, key string) (imageKey string, ok bool, err error)
+	Set(ctx context.Context, key, imageKey string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	imageKeyCacheMu sync.RWMutex
+	imageKeyCache   ImageKeyCache            = NewLRUImageKeyCache(defaultImageKeyCacheSize)
+	tenantCacheTTL  map[string]time.Duration = map[string]time.Duration{}
+
+	negativeCacheAttempts sync.Map // contentCacheKey -> consecutive failure count (int)
+)
+
+// SetImageKeyCache replaces the backend used by GetImageKey. Call it once
+// during startup, before any GetImageKey calls; it is not safe to call
+// concurrently with GetImageKey.
+func SetImageKeyCache(c ImageKeyCache) {
+	imageKeyCacheMu.Lock()
+	imageKeyCache = c
+	imageKeyCacheMu.Unlock()
+}
+
+func getImageKeyCache() ImageKeyCache {
+	imageKeyCacheMu.RLock()
+	defer imageKeyCacheMu.RUnlock()
+	return imageKeyCache
+}
+
+// SetTenantImageKeyCacheTTL overrides the cache TTL used for images
+// uploaded on behalf of tenantKey. A ttl <= 0 resets it back to
+// defaultImageKeyCacheTTL.
+func SetTenantImageKeyCacheTTL(tenantKey string, ttl time.Duration) {
+	imageKeyCacheMu.Lock()
+	defer imageKeyCacheMu.Unlock()
+	if ttl <= 0 {
+		delete(tenantCacheTTL, tenantKey)
+		return
+	}
+	tenantCacheTTL[tenantKey] = ttl
+}
+
+func imageKeyCacheTTL(tenantKey string) time.Duration {
+	imageKeyCacheMu.RLock()
+	defer imageKeyCacheMu.RUnlock()
+	if ttl, ok := tenantCacheTTL[tenantKey]; ok {
+		return ttl
+	}
+	return defaultImageKeyCacheTTL
+}
+
+// negativeCacheTTL returns the next backoff TTL for key, lengthening it
+// exponentially with each consecutive failure until negativeCacheMaxTTL.
+func negativeCacheTTL(key string) time.Duration {
+	v, _ := negativeCacheAttempts.LoadOrStore(key, 0)
+	attempt := v.(int)
+	negativeCacheAttempts.Store(key, attempt+1)
+
+	if attempt > 10 {
+		attempt = 10
+	}
+	ttl := negativeCacheBaseTTL * time.Duration(int64(1)<<uint(attempt))
+	if ttl > negativeCacheMaxTTL {
+		ttl = negativeCacheMaxTTL
+	}
+	return ttl
+}
+
+func clearNegativeCacheAttempts(key string) {
+	negativeCacheAttempts.Delete(key)
+}
+
+// LRUImageKeyCache is the default, process-local ImageKeyCache backed by
+// hashicorp/golang-lru. Unlike the pre-existing LruCache it replaced, it
+// honors per-entry TTLs (checked lazily on Get), which negative caching and
+// urlHashCache both depend on to expire.
+type LRUImageKeyCache struct {
+	cache *lru.Cache
+}
+
+// lruCacheEntry is the value type stored in LRUImageKeyCache.cache. A zero
+// expiresAt means the entry never expires.
+type lruCacheEntry struct {
+	imageKey  string
+	expiresAt time.Time
+}
+
+func NewLRUImageKeyCache(size int) *LRUImageKeyCache {
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &LRUImageKeyCache{cache: c}
+}
+
+func (c *LRUImageKeyCache) Get(_ context.Context, key string) (string, bool, error) {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return "", false, nil
+	}
+	entry := v.(lruCacheEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.cache.Remove(key)
+		return "", false, nil
+	}
+	return entry.imageKey, true, nil
+}
+
+func (c *LRUImageKeyCache) Set(_ context.Context, key, imageKey string, ttl time.Duration) error {
+	entry := lruCacheEntry{imageKey: imageKey}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	c.cache.Add(key, entry)
+	return nil
+}
+
+func (c *LRUImageKeyCache) Delete(_ context.Context, key string) error {
+	c.cache.Remove(key)
+	return nil
+}
+
+// RedisImageKeyCache stores image keys in Redis, honoring per-call TTLs so
+// entries expire and multi-instance bots share upload results.
+type RedisImageKeyCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisImageKeyCache returns a RedisImageKeyCache. keyPrefix is
+// prepended to every cache key, e.g. "botframework:imagekey:".
+func NewRedisImageKeyCache(client *redis.Client, keyPrefix string) *RedisImageKeyCache {
+	return &RedisImageKeyCache{client: client, prefix: keyPrefix}
+}
+
+func (c *RedisImageKeyCache) redisKey(key string) string {
+	return c.prefix + key
+}
+
+func (c *RedisImageKeyCache) Get(ctx context.Context, key string) (string, bool, error) {
+	v, err := c.client.Get(ctx, c.redisKey(key)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (c *RedisImageKeyCache) Set(ctx context.Context, key, imageKey string, ttl time.Duration) error {
+	return c.client.Set(ctx, c.redisKey(key), imageKey, ttl).Err()
+}
+
+func (c *RedisImageKeyCache) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, c.redisKey(key)).Err()
+}
+
+// FileImageKeyCache persists image keys as a single JSON file on disk, so
+// a single-instance bot's cache survives process restarts without standing
+// up Redis. It is not safe for multiple processes sharing the same file.
+type FileImageKeyCache struct {
+	mu   sync.Mutex
+	path string
+}
+
+type fileImageKeyCacheEntry struct {
+	ImageKey  string    `json:"image_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewFileImageKeyCache(path string) *FileImageKeyCache {
+	return &FileImageKeyCache{path: path}
+}
+
+func (c *FileImageKeyCache) load() (map[string]fileImageKeyCacheEntry, error) {
+	entries := map[string]fileImageKeyCacheEntry{}
+
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return entries, nil
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *FileImageKeyCache) save(entries map[string]fileImageKeyCacheEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(c.path, data, 0o644)
+}
+
+func (c *FileImageKeyCache) Get(_ context.Context, key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return "", false, err
+	}
+	entry, ok := entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	if !entry.ExpiresAt.IsZero() && time.Now().After(entry.ExpiresAt) {
+		delete(entries, key)
+		c.save(entries)
+		return "", false, nil
+	}
+	return entry.ImageKey, true, nil
+}
+
+func (c *FileImageKeyCache) Set(_ context.Context, key, imageKey string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+	entry := fileImageKeyCacheEntry{ImageKey: imageKey}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+	entries[key] = entry
+	return c.save(entries)
+}
+
+func (c *FileImageKeyCache) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+	delete(entries, key)
+	return c.save(entries)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/larksuite/botframework-go/SDK/common"
+)
+
+// uploadGroup coalesces concurrent GetImageKey calls uploading the same
+// content hash (e.g. two urls resolving to identical bytes) into a single
+// upload round-trip.
+var uploadGroup singleflight.Group
+
+// urlHashCacheTTL bounds how long a url->content-hash mapping is trusted;
+// past it a repeat url is re-downloaded in case its content changed. This
+// relies on the backend actually expiring entries after ttl -
+// NewLRUImageKeyCache (the default) does; a custom ImageKeyCache passed to
+// SetURLHashCache must too, or urlHashCache never expires and a changed url
+// is never re-downloaded.
+const urlHashCacheTTL = 24 * time.Hour
+
+var (
+	urlHashCacheMu sync.RWMutex
+	urlHashCache   ImageKeyCache = NewLRUImageKeyCache(defaultImageKeyCacheSize)
+)
+
+// SetURLHashCache replaces the backend used to remember which content hash
+// a url previously resolved to. Call it once during startup, before any
+// GetImageKey calls.
+func SetURLHashCache(c ImageKeyCache) {
+	urlHashCacheMu.Lock()
+	urlHashCache = c
+	urlHashCacheMu.Unlock()
+}
+
+func getURLHashCache() ImageKeyCache {
+	urlHashCacheMu.RLock()
+	defer urlHashCacheMu.RUnlock()
+	return urlHashCache
+}
+
+// resolvedContentHash returns the content hash a previous GetImageKey(url)
+// call resolved to, without performing any network request.
+func resolvedContentHash(ctx context.Context, url string) (string, bool) {
+	if url == "" {
+		return "", false
+	}
+	hash, ok, err := getURLHashCache().Get(ctx, url)
+	if err != nil || !ok || hash == "" {
+		return "", false
+	}
+	return hash, true
+}
+
+// rememberURLContentHash records that url's content hashed to hash, so the
+// next GetImageKey(url) call can skip the download on an imageKeyCache hit.
+func rememberURLContentHash(ctx context.Context, url, hash string) {
+	if url == "" {
+		return
+	}
+	getURLHashCache().Set(ctx, url, hash, urlHashCacheTTL)
+}
+
+// precheckURL issues a cheap HEAD request (falling back to a single-byte
+// ranged GET for servers that don't implement HEAD) and rejects obviously
+// bad urls - a Content-Length over opts.MaxBytes, or a disallowed
+// Content-Type - before downloadImage spends bandwidth on the full body.
+// A failure to even make the request is not itself an error here; it's
+// left for the real download to report.
+func precheckURL(url string, opts ImageUploadOptions) error {
+	client := opts.httpClient()
+
+	resp, err := doPrecheckRequest(client, http.MethodHead, url, "")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		resp, err = doPrecheckRequest(client, http.MethodGet, url, "bytes=0-0")
+		if err != nil {
+			return nil
+		}
+		defer resp.Body.Close()
+	}
+
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		// A ranged reply's Content-Length is that of the range; the full
+		// size follows the "/" in Content-Range, e.g. "bytes 0-0/12345".
+		size = -1
+		if cr := resp.Header.Get("Content-Range"); strings.Contains(cr, "/") {
+			if total, err := strconv.ParseInt(cr[strings.LastIndexByte(cr, '/')+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+	}
+	if size > 0 && size > opts.maxBytes() {
+		return common.ErrImageTooLarge.Error()
+	}
+	if ct := stripContentTypeParams(resp.Header.Get("Content-Type")); ct != "" && !allowedImageContentTypes[ct] {
+		return common.ErrImageTypeNotAllowed.ErrorWithExtStr(ct)
+	}
+	return nil
+}
+
+func doPrecheckRequest(client *http.Client, method, url, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	return client.Do(req)
+}
+
+func stripContentTypeParams(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		return strings.TrimSpace(contentType[:i])
+	}
+	return contentType
+}
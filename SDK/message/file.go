@@ -0,0 +1,620 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/larksuite/botframework-go/SDK/auth"
+	"github.com/larksuite/botframework-go/SDK/common"
+	"github.com/larksuite/botframework-go/SDK/protocol"
+)
+
+const (
+	// defaultMaxFileBytes is used when FileUploadPolicy has no cap set for
+	// a given Content-Type and no generic MaxBytes either.
+	defaultMaxFileBytes = 100 << 20 // 100MB
+
+	// defaultFileChunkSize is the chunk size used for the resumable upload
+	// path when FileUploadPolicy.ChunkSize is unset.
+	defaultFileChunkSize = 4 << 20 // 4MB
+
+	// chunkUploadStateTTL bounds how long an interrupted chunked upload can
+	// be resumed before it's abandoned and restarted from scratch.
+	chunkUploadStateTTL = 24 * time.Hour
+)
+
+// allowedFileContentTypes is the MIME allow-list enforced by default on
+// every GetFileKey/GenBinaryFileBy* call, covering the common office,
+// document, video and audio attachment types. It's keyed on what
+// http.DetectContentType actually returns for these formats, not their
+// logical/registered MIME type: docx/xlsx/pptx all sniff to
+// "application/zip", legacy doc/xls/ppt to "application/octet-stream", and
+// opus/ogg audio to "application/ogg". Since those three are generic
+// container types shared with plenty of non-file formats, a content type
+// match alone isn't enough - see allowedContainerExtensions.
+var allowedFileContentTypes = map[string]bool{
+	"application/pdf":          true,
+	"application/zip":          true, // docx, xlsx, pptx
+	"application/octet-stream": true, // doc, xls, ppt
+	"application/ogg":          true, // opus, ogg
+	"video/mp4":                true,
+}
+
+// allowedContainerExtensions narrows the generic container Content-Types in
+// allowedFileContentTypes (zip/octet-stream/ogg) down to the specific file
+// extensions this package supports, since DetectContentType can't tell a
+// docx apart from any other zip, or a legacy doc from any other
+// octet-stream blob.
+var allowedContainerExtensions = map[string]bool{
+	".doc":  true,
+	".docx": true,
+	".xls":  true,
+	".xlsx": true,
+	".ppt":  true,
+	".pptx": true,
+	".opus": true,
+	".ogg":  true,
+}
+
+// needsExtensionCheck reports whether contentType is one of the generic
+// container types in allowedFileContentTypes that needs
+// allowedContainerExtensions to confirm it's actually a supported
+// attachment, rather than some other zip/octet-stream/ogg payload.
+func needsExtensionCheck(contentType string) bool {
+	switch contentType {
+	case "application/zip", "application/octet-stream", "application/ogg":
+		return true
+	default:
+		return false
+	}
+}
+
+// validateFileContentType checks contentType against policy.allowed(), and
+// for the generic container types additionally requires name's extension to
+// be one of allowedContainerExtensions.
+func validateFileContentType(contentType, name string, policy FileUploadPolicy) error {
+	if !policy.allowed()[contentType] {
+		return common.ErrFileTypeNotAllowed.ErrorWithExtStr(contentType)
+	}
+	if needsExtensionCheck(contentType) && !allowedContainerExtensions[strings.ToLower(filepath.Ext(name))] {
+		return common.ErrFileTypeNotAllowed.ErrorWithExtStr(contentType)
+	}
+	return nil
+}
+
+// FileUploadPolicy controls validation, chunking and download behavior for
+// GetFileKey and the GenBinaryFileBy* helpers.
+type FileUploadPolicy struct {
+	// MaxBytes caps upload size for any Content-Type not covered by
+	// MaxBytesByContentType. Zero means defaultMaxFileBytes.
+	MaxBytes int64
+
+	// MaxBytesByContentType overrides MaxBytes per MIME type, e.g. a
+	// smaller cap for "application/pdf" than for "video/mp4". Only
+	// GetFileKey applies it, after the source has already been read under
+	// MaxBytes (or defaultMaxFileBytes), so a per-type cap above that has
+	// no effect; the GenBinaryFileBy* helpers apply MaxBytes alone.
+	MaxBytesByContentType map[string]int64
+
+	// AllowedContentTypes overrides allowedFileContentTypes. Nil means the
+	// package default.
+	AllowedContentTypes map[string]bool
+
+	// ChunkSize is the size of each part in the chunked-upload path. Files
+	// larger than ChunkSize are uploaded chunk by chunk and resumed from
+	// the file key cache (see SetFileKeyCache). Zero means
+	// defaultFileChunkSize.
+	ChunkSize int64
+
+	// HTTPClient is used for url downloads; nil means a client with
+	// defaultDownloadTimeout.
+	HTTPClient *http.Client
+}
+
+func (p FileUploadPolicy) maxBytesFor(contentType string) int64 {
+	if v, ok := p.MaxBytesByContentType[contentType]; ok && v > 0 {
+		return v
+	}
+	if p.MaxBytes > 0 {
+		return p.MaxBytes
+	}
+	return defaultMaxFileBytes
+}
+
+func (p FileUploadPolicy) allowed() map[string]bool {
+	if p.AllowedContentTypes != nil {
+		return p.AllowedContentTypes
+	}
+	return allowedFileContentTypes
+}
+
+func (p FileUploadPolicy) chunkSize() int64 {
+	if p.ChunkSize > 0 {
+		return p.ChunkSize
+	}
+	return defaultFileChunkSize
+}
+
+func (p FileUploadPolicy) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: defaultDownloadTimeout}
+}
+
+var (
+	fileKeyCacheMu sync.RWMutex
+	fileKeyCache   ImageKeyCache = NewLRUImageKeyCache(defaultImageKeyCacheSize)
+)
+
+// SetFileKeyCache replaces the backend used by GetFileKey, mirroring
+// SetImageKeyCache. Call it once during startup, before any GetFileKey
+// calls.
+func SetFileKeyCache(c ImageKeyCache) {
+	fileKeyCacheMu.Lock()
+	fileKeyCache = c
+	fileKeyCacheMu.Unlock()
+}
+
+func getFileKeyCache() ImageKeyCache {
+	fileKeyCacheMu.RLock()
+	defer fileKeyCacheMu.RUnlock()
+	return fileKeyCache
+}
+
+// GetFileKey: get file_key, file_type = message
+//
+// Like GetImageKey, uploads are cached and deduped by the SHA-256 of the
+// file's content. Files larger than policy.ChunkSize are uploaded in
+// fixed-size chunks with resumable state kept in the same pluggable cache,
+// so an interrupted upload picks up from the last acknowledged chunk
+// instead of restarting.
+func GetFileKey(ctx context.Context, tenantKey, appID, url, path string, policy FileUploadPolicy) (string, error) {
+	if url == "" && path == "" {
+		return "", common.ErrFileParams.Error()
+	}
+
+	raw, name, err := readFileSource(url, path, policy)
+	if err != nil {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(raw)
+	if err := validateFileContentType(contentType, name, policy); err != nil {
+		return "", err
+	}
+	if max := policy.maxBytesFor(contentType); int64(len(raw)) > max {
+		return "", common.ErrFileTooLarge.Error()
+	}
+
+	cacheKey := contentCacheKey(raw)
+	cache := getFileKeyCache()
+	if fileKey, ok, err := cache.Get(ctx, cacheKey); err == nil && ok && fileKey != "" {
+		return fileKey, nil
+	}
+
+	fileType := protocol.MessageFileType
+
+	var fileKey string
+	if int64(len(raw)) > policy.chunkSize() {
+		fileKey, err = uploadFileChunked(ctx, tenantKey, appID, raw, name, cacheKey, policy)
+	} else {
+		body, mpContentType := streamMultipartFile(name, string(fileType), bytes.NewReader(raw), nil)
+		var rspData *protocol.UpLoadFileResponse
+		rspData, err = UploadFile(ctx, tenantKey, appID, body, mpContentType)
+		if err == nil {
+			fileKey = rspData.Data.FileKey
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cache.Set(ctx, cacheKey, fileKey, defaultImageKeyCacheTTL)
+
+	return fileKey, nil
+}
+
+// UploadFile streams body (as produced by GenBinaryFileByPath/Url) to the
+// open-platform file upload API.
+func UploadFile(ctx context.Context, tenantKey, appID string, body io.Reader, contentType string) (rspData *protocol.UpLoadFileResponse, err error) {
+	// body is commonly the read end of an io.Pipe fed by a goroutine in
+	// streamMultipartFile; if we return below without ever reading it
+	// (e.g. token fetch fails), that goroutine would block on its next
+	// Write forever. Closing it on any error path unblocks the writer so
+	// its cleanup (closing the underlying file, for GenBinaryFileByPath)
+	// still runs.
+	if closer, ok := body.(io.Closer); ok {
+		defer func() {
+			if err != nil {
+				closer.Close()
+			}
+		}()
+	}
+
+	accessToken, err := auth.GetTenantAccessToken(ctx, tenantKey, appID)
+	if err != nil {
+		return nil, err
+	}
+	authorization := fmt.Sprintf("Bearer %s", accessToken)
+	header := map[string]string{"Authorization": authorization, "Content-Type": contentType}
+
+	reqURL := common.GetOpenPlatformHost() + string(protocol.UploadFilePath)
+	rspBytes, _, err := common.DoHttp(common.HTTPMethodPost, reqURL, header, body)
+	if err != nil {
+		return nil, common.ErrOpenApiFailed.ErrorWithExtErr(err)
+	}
+
+	rspData = &protocol.UpLoadFileResponse{}
+	err = json.Unmarshal(rspBytes, &rspData)
+	if err != nil {
+		return nil, common.ErrJsonUnmarshal.ErrorWithExtErr(err)
+	}
+
+	if rspData.Code != 0 {
+		auth.CheckAndDisableTenantToken(ctx, appID, tenantKey, rspData.Code)
+		return rspData, common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+	}
+
+	return rspData, nil
+}
+
+// GenBinaryFileByPath streams the file at path through validation and into
+// a multipart request body, mirroring GenBinaryImageByPath for generic
+// attachments.
+func GenBinaryFileByPath(path string, fileType protocol.FileType, policy FileUploadPolicy) (io.Reader, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("open file error[%v]", err)
+	}
+
+	body, err := prepareFileReader(file, path, policy)
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	reader, contentType := streamMultipartFile(path, string(fileType), body, file.Close)
+	return reader, contentType, nil
+}
+
+// GenBinaryFileByUrl downloads url (respecting policy.MaxBytes/HTTPClient),
+// validates it, and streams it into a multipart request body.
+func GenBinaryFileByUrl(url string, fileType protocol.FileType, policy FileUploadPolicy) (io.Reader, string, error) {
+	raw, err := downloadFile(url, policy)
+	if err != nil {
+		return nil, "", fmt.Errorf("download file error[%v]", err)
+	}
+
+	parts := strings.Split(url, "/")
+	name := parts[0]
+	if len(parts) > 1 {
+		name = parts[len(parts)-1]
+	}
+
+	body, err := prepareFileReader(bytes.NewReader(raw), name, policy)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, contentType := streamMultipartFile(name, string(fileType), body, nil)
+	return reader, contentType, nil
+}
+
+// prepareFileReader enforces policy's generic MaxBytes and validates the
+// sniffed Content-Type (see validateFileContentType). Unlike GetFileKey, it
+// cannot apply a per-Content-Type cap up front since the size isn't known
+// until the stream is fully read.
+func prepareFileReader(r io.Reader, name string, policy FileUploadPolicy) (io.Reader, error) {
+	limited := &maxBytesReader{r: r, n: policy.maxBytesFor("")}
+
+	sniffBuf := make([]byte, sniffLen)
+	n, err := io.ReadFull(limited, sniffBuf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("read header error[%v]", err)
+	}
+	sniffBuf = sniffBuf[:n]
+
+	contentType := http.DetectContentType(sniffBuf)
+	if err := validateFileContentType(contentType, name, policy); err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(sniffBuf), limited), nil
+}
+
+// streamMultipartFile mirrors streamMultipartImage for generic attachments:
+// it writes content into a multipart/form-data body on a pipe so the
+// caller can hand the returned reader straight to an HTTP request.
+func streamMultipartFile(fileName, fileType string, content io.Reader, cleanup func() error) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	contentType := writer.FormDataContentType()
+
+	go func() {
+		var err error
+		defer func() {
+			if cleanup != nil {
+				cleanup()
+			}
+			pw.CloseWithError(err)
+		}()
+
+		var part io.Writer
+		part, err = writer.CreateFormFile("file", fileName)
+		if err != nil {
+			return
+		}
+		if _, err = io.Copy(part, content); err != nil {
+			return
+		}
+		if err = writer.WriteField("file_type", fileType); err != nil {
+			return
+		}
+		err = writer.Close()
+	}()
+
+	return pr, contentType
+}
+
+func downloadFile(url string, policy FileUploadPolicy) ([]byte, error) {
+	resp, err := policy.httpClient().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("http get error[%v]", err)
+	}
+	defer resp.Body.Close()
+
+	limited := &maxBytesReader{r: resp.Body, n: policy.maxBytesFor("")}
+	return io.ReadAll(limited)
+}
+
+// readFileSource loads the full content of the path- or url-sourced file
+// (enforcing policy's generic MaxBytes) so GetFileKey can hash it for
+// cache lookups and, if needed, split it into chunks.
+func readFileSource(url, path string, policy FileUploadPolicy) ([]byte, string, error) {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("open file error[%v]", err)
+		}
+		defer file.Close()
+
+		raw, err := io.ReadAll(&maxBytesReader{r: file, n: policy.maxBytesFor("")})
+		if err != nil {
+			return nil, "", err
+		}
+		return raw, path, nil
+	}
+
+	raw, err := downloadFile(url, policy)
+	if err != nil {
+		return nil, "", fmt.Errorf("download file error[%v]", err)
+	}
+
+	parts := strings.Split(url, "/")
+	name := parts[0]
+	if len(parts) > 1 {
+		name = parts[len(parts)-1]
+	}
+	return raw, name, nil
+}
+
+// chunkUploadState is the resumable state persisted (as JSON) in the file
+// key cache (see SetFileKeyCache), keyed by the content hash of the file
+// being uploaded.
+type chunkUploadState struct {
+	SessionID      string `json:"session_id"`
+	TotalChunks    int    `json:"total_chunks"`
+	NextChunkIndex int    `json:"next_chunk_index"`
+}
+
+func loadChunkUploadState(ctx context.Context, key string) (*chunkUploadState, error) {
+	v, ok, err := getFileKeyCache().Get(ctx, chunkStateCacheKey(key))
+	if err != nil || !ok || v == "" {
+		return nil, err
+	}
+	state := &chunkUploadState{}
+	if err := json.Unmarshal([]byte(v), state); err != nil {
+		// Stale/corrupt state: treat as no state and start the upload over.
+		return nil, nil
+	}
+	return state, nil
+}
+
+func saveChunkUploadState(ctx context.Context, key string, state *chunkUploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return getFileKeyCache().Set(ctx, chunkStateCacheKey(key), string(data), chunkUploadStateTTL)
+}
+
+func deleteChunkUploadState(ctx context.Context, key string) {
+	getFileKeyCache().Delete(ctx, chunkStateCacheKey(key))
+}
+
+func chunkStateCacheKey(contentHash string) string {
+	return "chunked:" + contentHash
+}
+
+// uploadFileChunked splits raw into policy.chunkSize() parts and uploads
+// them one at a time, persisting progress after each chunk so a process
+// restart resumes from state.NextChunkIndex instead of re-uploading
+// everything.
+func uploadFileChunked(ctx context.Context, tenantKey, appID string, raw []byte, name, cacheKey string, policy FileUploadPolicy) (string, error) {
+	chunkSize := policy.chunkSize()
+	totalChunks := int((int64(len(raw)) + chunkSize - 1) / chunkSize)
+
+	state, err := loadChunkUploadState(ctx, cacheKey)
+	if err != nil {
+		return "", err
+	}
+	if state == nil || state.TotalChunks != totalChunks {
+		sessionID, err := startFileUploadSession(ctx, tenantKey, appID, name, int64(len(raw)), totalChunks)
+		if err != nil {
+			return "", err
+		}
+		state = &chunkUploadState{SessionID: sessionID, TotalChunks: totalChunks}
+		if err := saveChunkUploadState(ctx, cacheKey, state); err != nil {
+			return "", err
+		}
+	}
+
+	for state.NextChunkIndex < state.TotalChunks {
+		start := int64(state.NextChunkIndex) * chunkSize
+		end := start + chunkSize
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+
+		if err := uploadFileChunk(ctx, tenantKey, appID, state.SessionID, state.NextChunkIndex, state.TotalChunks, raw[start:end]); err != nil {
+			return "", err
+		}
+
+		state.NextChunkIndex++
+		if err := saveChunkUploadState(ctx, cacheKey, state); err != nil {
+			return "", err
+		}
+	}
+
+	fileKey, err := commitFileUpload(ctx, tenantKey, appID, state.SessionID)
+	if err != nil {
+		return "", err
+	}
+
+	deleteChunkUploadState(ctx, cacheKey)
+
+	return fileKey, nil
+}
+
+// startFileUploadSession opens a chunked upload session, mirroring the
+// ArtworkChunkBasePath session-then-chunks-then-commit pattern.
+func startFileUploadSession(ctx context.Context, tenantKey, appID, fileName string, fileSize int64, totalChunks int) (string, error) {
+	accessToken, err := auth.GetTenantAccessToken(ctx, tenantKey, appID)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
+	writer.WriteField("file_name", fileName)
+	writer.WriteField("file_size", strconv.FormatInt(fileSize, 10))
+	writer.WriteField("total_chunks", strconv.Itoa(totalChunks))
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	header := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", accessToken),
+		"Content-Type":  writer.FormDataContentType(),
+	}
+	reqURL := common.GetOpenPlatformHost() + string(protocol.StartFileUploadPath)
+	rspBytes, _, err := common.DoHttp(common.HTTPMethodPost, reqURL, header, buffer)
+	if err != nil {
+		return "", common.ErrOpenApiFailed.ErrorWithExtErr(err)
+	}
+
+	rspData := &protocol.StartFileUploadResponse{}
+	if err := json.Unmarshal(rspBytes, rspData); err != nil {
+		return "", common.ErrJsonUnmarshal.ErrorWithExtErr(err)
+	}
+	if rspData.Code != 0 {
+		auth.CheckAndDisableTenantToken(ctx, appID, tenantKey, rspData.Code)
+		return "", common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+	}
+
+	return rspData.Data.UploadSessionID, nil
+}
+
+// uploadFileChunk POSTs a single chunk tagged with its index, the total
+// chunk count, and the upload session id, so the server can acknowledge it
+// and the caller can resume after index on failure.
+func uploadFileChunk(ctx context.Context, tenantKey, appID, sessionID string, index, total int, chunk []byte) error {
+	accessToken, err := auth.GetTenantAccessToken(ctx, tenantKey, appID)
+	if err != nil {
+		return err
+	}
+
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
+	part, err := writer.CreateFormFile("chunk", fmt.Sprintf("chunk-%d", index))
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(chunk); err != nil {
+		return err
+	}
+	writer.WriteField("upload_session_id", sessionID)
+	writer.WriteField("chunk_index", strconv.Itoa(index))
+	writer.WriteField("total_chunks", strconv.Itoa(total))
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	header := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", accessToken),
+		"Content-Type":  writer.FormDataContentType(),
+	}
+	reqURL := common.GetOpenPlatformHost() + string(protocol.UploadFileChunkPath)
+	rspBytes, _, err := common.DoHttp(common.HTTPMethodPost, reqURL, header, buffer)
+	if err != nil {
+		return common.ErrOpenApiFailed.ErrorWithExtErr(err)
+	}
+
+	rspData := &protocol.UploadFileChunkResponse{}
+	if err := json.Unmarshal(rspBytes, rspData); err != nil {
+		return common.ErrJsonUnmarshal.ErrorWithExtErr(err)
+	}
+	if rspData.Code != 0 {
+		auth.CheckAndDisableTenantToken(ctx, appID, tenantKey, rspData.Code)
+		return common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+	}
+
+	return nil
+}
+
+// commitFileUpload finalizes a chunked upload session once every chunk has
+// been acknowledged, returning the resulting file_key.
+func commitFileUpload(ctx context.Context, tenantKey, appID, sessionID string) (string, error) {
+	accessToken, err := auth.GetTenantAccessToken(ctx, tenantKey, appID)
+	if err != nil {
+		return "", err
+	}
+
+	rspBytes, httpCode, err := common.DoHttpPostOApi(protocol.CommitFileUploadPath,
+		map[string]string{"Authorization": fmt.Sprintf("Bearer %s", accessToken)},
+		map[string]string{"upload_session_id": sessionID},
+	)
+	if err != nil {
+		return "", common.ErrOpenApiFailed.ErrorWithExtErr(err)
+	}
+	if httpCode != common.HTTPCodeOK {
+		return "", common.ErrHttpCode.ErrorWithExtStr(fmt.Sprintf("httpCode[%d]httpRspBody[%s]", httpCode, string(rspBytes)))
+	}
+
+	rspData := &protocol.CommitFileUploadResponse{}
+	if err := json.Unmarshal(rspBytes, rspData); err != nil {
+		return "", common.ErrJsonUnmarshal.ErrorWithExtErr(err)
+	}
+	if rspData.Code != 0 {
+		auth.CheckAndDisableTenantToken(ctx, appID, tenantKey, rspData.Code)
+		return "", common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+	}
+
+	return rspData.Data.FileKey, nil
+}
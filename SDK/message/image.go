@@ -7,87 +7,260 @@ package message
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"go.opentelemetry.io/otel/attribute"
 
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/larksuite/botframework-go/SDK/auth"
 	"github.com/larksuite/botframework-go/SDK/common"
 	"github.com/larksuite/botframework-go/SDK/protocol"
 )
 
 const (
-	localCacheSize = 1000000
+	// defaultMaxImageBytes is used when ImageUploadOptions.MaxBytes is unset.
+	defaultMaxImageBytes = 10 << 20 // 10MB
+
+	// sniffLen mirrors the amount net/http reads to guess a Content-Type.
+	sniffLen = 512
+
+	// defaultDownloadTimeout is used when ImageUploadOptions.HTTPClient is unset.
+	defaultDownloadTimeout = 30 * time.Second
 )
 
-var (
-	LruCache *lru.Cache
+// EXIF orientation tag values, as defined by the EXIF spec and mirrored by
+// Mattermost's image utils (mattermost-server/utils/imgutils).
+const (
+	orientationUpright           = 1
+	orientationFlipped           = 2
+	orientationUpsideDown        = 3
+	orientationUpsideDownFlipped = 4
+	orientationRotatedCWFlipped  = 5
+	orientationRotatedCCW        = 6
+	orientationRotatedCCWFlipped = 7
+	orientationRotatedCW         = 8
 )
 
-func init() {
-	var err error
-	LruCache, err = lru.New(localCacheSize)
-	if err != nil {
-		panic(err)
+// allowedImageContentTypes is the MIME allow-list enforced on every upload
+// and download, regardless of the claimed file extension.
+var allowedImageContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ImageUploadOptions controls streaming, validation and normalization of
+// image uploads performed by GetImageKey and the GenBinaryImage* helpers.
+type ImageUploadOptions struct {
+	// MaxBytes caps the number of bytes read from the source (file or
+	// download). Exceeding it aborts the upload with common.ErrImageTooLarge.
+	// Zero means defaultMaxImageBytes.
+	MaxBytes int64
+
+	// NormalizeOrientation decodes JPEGs and re-orients them per their EXIF
+	// orientation tag before upload, so downstream consumers never need to
+	// read EXIF themselves.
+	NormalizeOrientation bool
+
+	// HTTPClient is used to fetch url-sourced images. Nil means a client
+	// with defaultDownloadTimeout.
+	HTTPClient *http.Client
+
+	// GenerateThumbnails additionally produces, uploads and caches a
+	// resized variant per spec alongside the original. Populates
+	// MultiImageKeys.Thumbnails.
+	GenerateThumbnails []ThumbnailSpec
+}
+
+func (o ImageUploadOptions) maxBytes() int64 {
+	if o.MaxBytes > 0 {
+		return o.MaxBytes
+	}
+	return defaultMaxImageBytes
+}
+
+func (o ImageUploadOptions) httpClient() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
 	}
+	return &http.Client{Timeout: defaultDownloadTimeout}
 }
 
 // GetImageKey: get imagekey, image_type = message
-func GetImageKey(ctx context.Context, tenantKey, appID, url, path string) (string, error) {
+//
+// Uploaded images are cached by the SHA-256 of their content (not by url/
+// path), so the same image served from two sources dedupes, and a cache
+// backend set via SetImageKeyCache persists hits across process restarts.
+// A prior upload failure for the same content is also cached for a short,
+// exponentially-growing backoff window so a broken url/path doesn't get
+// retried against the open-platform API on every call.
+//
+// For url-sourced images, a previously-seen url skips the download
+// entirely via urlHashCache. Concurrent callers uploading the same content
+// (e.g. two urls resolving to identical bytes) share a single upload
+// round-trip through uploadGroup.
+//
+// When opts.GenerateThumbnails is set, each spec is additionally resized,
+// uploaded and cached alongside the original; see MultiImageKeys.
+func GetImageKey(ctx context.Context, tenantKey, appID, url, path string, opts ImageUploadOptions) (result *MultiImageKeys, err error) {
+	cacheHit := false
+	ctx, endSpan := startSpan(ctx, "message.GetImageKey",
+		attribute.String("tenant_key", tenantKey),
+		attribute.String("app_id", appID),
+		attribute.String("image_type", string(protocol.MessageImageType)),
+	)
+	defer func() { endSpan(err, attribute.Bool("cache_hit", cacheHit)) }()
+
 	if url == "" && path == "" {
-		return "", common.ErrImageParams.Error()
+		return nil, common.ErrImageParams.Error()
 	}
 
-	// get from cache
-	var cacheKey string
-	if path != "" {
-		cacheKey = path
-	} else {
-		cacheKey = url
+	cache := getImageKeyCache()
+
+	if hash, ok := resolvedContentHash(ctx, url); ok {
+		if imageKey, found, findErr := cache.Get(ctx, hash); findErr == nil && found && imageKey != "" {
+			if thumbnails, complete := lookupCachedThumbnails(ctx, hash, opts.GenerateThumbnails); complete {
+				cacheHit = true
+				recordCacheHit()
+				result = &MultiImageKeys{ImageKey: imageKey, Thumbnails: thumbnails}
+				return result, nil
+			}
+			// Some requested thumbnail variants aren't cached yet (e.g.
+			// GenerateThumbnails grew since this url was last uploaded).
+			// Fall through to the full read below so they get generated
+			// instead of silently omitting them.
+		}
 	}
 
-	if v, ok := LruCache.Get(cacheKey); ok {
-		imageKey := v.(string)
+	if url != "" {
+		if err = precheckURL(url, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, name, err := readImageSource(ctx, url, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := contentCacheKey(raw)
+	rememberURLContentHash(ctx, url, cacheKey)
+
+	if imageKey, ok, findErr := cache.Get(ctx, cacheKey); findErr == nil && ok {
 		if imageKey != "" {
-			return imageKey, nil
+			cacheHit = true
+			recordCacheHit()
+			result, err = withThumbnails(ctx, tenantKey, appID, raw, cacheKey, imageKey, opts)
+			return result, err
 		}
-		LruCache.Remove(cacheKey)
+		err = common.ErrImageUploadRecentlyFailed.Error()
+		return nil, err
 	}
 
-	// upload image
-	imageType := protocol.MessageImageType
-	var body *bytes.Buffer
-	var contentType string
-	var err error
-	if path != "" {
-		body, contentType, err = GenBinaryImageByPath(path, imageType)
+	uploaded, err, _ := uploadGroup.Do(cacheKey, func() (interface{}, error) {
+		imageType := protocol.MessageImageType
+		body, err := prepareImageReader(bytes.NewReader(raw), opts)
 		if err != nil {
 			return "", common.ErrGenBinImageFailed.ErrorWithExtErr(err)
 		}
-	} else {
-		body, contentType, err = GenBinaryImageByUrl(url, imageType)
+		reader, contentType := streamMultipartImage("image", name, string(imageType), body, nil)
+
+		rspData, err := UploadImage(ctx, tenantKey, appID, reader, contentType)
 		if err != nil {
-			return "", common.ErrGenBinImageFailed.ErrorWithExtErr(err)
+			cache.Set(ctx, cacheKey, "", negativeCacheTTL(cacheKey))
+			return "", err
+		}
+
+		clearNegativeCacheAttempts(cacheKey)
+		cache.Set(ctx, cacheKey, rspData.Data.ImageKey, imageKeyCacheTTL(tenantKey))
+
+		return rspData.Data.ImageKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err = withThumbnails(ctx, tenantKey, appID, raw, cacheKey, uploaded.(string), opts)
+	return result, err
+}
+
+// withThumbnails assembles the MultiImageKeys result for imageKey,
+// generating opts.GenerateThumbnails from raw if requested. Callers on the
+// urlHashCache-hit path (where raw isn't read) must instead resolve
+// thumbnails via lookupCachedThumbnails, since that path never reaches here
+// unless every requested variant is already cached.
+func withThumbnails(ctx context.Context, tenantKey, appID string, raw []byte, cacheKey, imageKey string, opts ImageUploadOptions) (*MultiImageKeys, error) {
+	result := &MultiImageKeys{ImageKey: imageKey}
+	if len(opts.GenerateThumbnails) == 0 {
+		return result, nil
+	}
+
+	// Thumbnails are best-effort: the original has already uploaded
+	// successfully by this point, so a failure resizing/uploading one
+	// variant returns whatever variants did succeed rather than discarding
+	// the original imageKey.
+	thumbnails, _ := generateThumbnails(ctx, tenantKey, appID, raw, opts.GenerateThumbnails, cacheKey)
+	result.Thumbnails = thumbnails
+
+	return result, nil
+}
+
+// readImageSource loads the full content of the path- or url-sourced image
+// (enforcing opts.MaxBytes) so GetImageKey can hash it for cache lookups,
+// and returns a suggested file name for the multipart upload.
+func readImageSource(ctx context.Context, url, path string, opts ImageUploadOptions) ([]byte, string, error) {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("open file error[%v]", err)
 		}
+		defer file.Close()
+
+		raw, err := io.ReadAll(&maxBytesReader{r: file, n: opts.maxBytes()})
+		if err != nil {
+			return nil, "", err
+		}
+		return raw, path, nil
 	}
 
-	rspData, err := UploadImage(ctx, tenantKey, appID, body, contentType)
+	raw, err := downloadImage(ctx, url, opts)
 	if err != nil {
-		return "", err
+		return nil, "", fmt.Errorf("download image error[%v]", err)
 	}
 
-	addLruCache(cacheKey, rspData.Data.ImageKey)
+	parts := strings.Split(url, "/")
+	name := parts[0]
+	if len(parts) > 1 {
+		name = parts[len(parts)-1]
+	}
+	return raw, name, nil
+}
 
-	return rspData.Data.ImageKey, nil
+// contentCacheKey is the SHA-256 hex digest used to key ImageKeyCache
+// entries, so identical images dedupe regardless of their source url/path.
+func contentCacheKey(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
 }
 
-func GetImageBinData(ctx context.Context, tenantKey, appID, imageKey string) ([]byte, error) {
+func GetImageBinData(ctx context.Context, tenantKey, appID, imageKey string) (rspBytes []byte, err error) {
+	ctx, endSpan := startSpan(ctx, "message.GetImageBinData",
+		attribute.String("tenant_key", tenantKey),
+		attribute.String("app_id", appID),
+	)
+	defer func() { endSpan(err) }()
+
 	if appID == "" || imageKey == "" {
 		return nil, common.ErrGetImageBinDataParams.ErrorWithExtStr("param is empty")
 	}
@@ -97,7 +270,8 @@ func GetImageBinData(ctx context.Context, tenantKey, appID, imageKey string) ([]
 		return nil, err
 	}
 
-	rspBytes, httpCode, err := common.DoHttpGetOApi(protocol.GetImagePath,
+	var httpCode int
+	rspBytes, httpCode, err = common.DoHttpGetOApi(protocol.GetImagePath,
 		map[string]string{"Authorization": fmt.Sprintf("Bearer %s", accessToken)},
 		map[string]string{"image_key": imageKey},
 	)
@@ -106,13 +280,44 @@ func GetImageBinData(ctx context.Context, tenantKey, appID, imageKey string) ([]
 	}
 
 	if httpCode != common.HTTPCodeOK {
-		return nil, common.ErrHttpCode.ErrorWithExtStr(fmt.Sprintf("httpCode[%d]httpRspBody[%s]", httpCode, string(rspBytes)))
+		err = common.ErrHttpCode.ErrorWithExtStr(fmt.Sprintf("httpCode[%d]httpRspBody[%s]", httpCode, string(rspBytes)))
+		return nil, err
 	}
 
 	return rspBytes, nil
 }
 
-func UploadImage(ctx context.Context, tenantKey, appID string, body *bytes.Buffer, contentType string) (*protocol.UpLoadImageResponse, error) {
+// UploadImage streams body (as produced by GenBinaryImageByPath/Url) to the
+// open-platform image upload API.
+func UploadImage(ctx context.Context, tenantKey, appID string, body io.Reader, contentType string) (rspData *protocol.UpLoadImageResponse, err error) {
+	ctx, endSpan := startSpan(ctx, "message.UploadImage",
+		attribute.String("tenant_key", tenantKey),
+		attribute.String("app_id", appID),
+	)
+	start := time.Now()
+	openAPICode := 0
+	countingBody := &byteCountingReader{r: body}
+	defer func() {
+		recordUpload(time.Since(start), countingBody.n)
+		endSpan(err,
+			attribute.Int64("bytes_uploaded", countingBody.n),
+			attribute.Int("open_api_code", openAPICode),
+		)
+	}()
+	// body is commonly the read end of an io.Pipe fed by a goroutine in
+	// streamMultipartImage; if we return below without ever reading it
+	// (e.g. token fetch fails), that goroutine would block on its next
+	// Write forever. Closing it on any error path unblocks the writer so
+	// its cleanup (closing the underlying file, for GenBinaryImageByPath)
+	// still runs.
+	if closer, ok := body.(io.Closer); ok {
+		defer func() {
+			if err != nil {
+				closer.Close()
+			}
+		}()
+	}
+
 	accessToken, err := auth.GetTenantAccessToken(ctx, tenantKey, appID)
 	if err != nil {
 		return nil, err
@@ -121,98 +326,287 @@ func UploadImage(ctx context.Context, tenantKey, appID string, body *bytes.Buffe
 	header := map[string]string{"Authorization": authorization, "Content-Type": contentType}
 
 	reqURL := common.GetOpenPlatformHost() + string(protocol.UploadImagePath)
-	rspBytes, _, err := common.DoHttp(common.HTTPMethodPost, reqURL, header, body)
+	rspBytes, _, err := common.DoHttp(common.HTTPMethodPost, reqURL, header, countingBody)
 	if err != nil {
 		return nil, common.ErrOpenApiFailed.ErrorWithExtErr(err)
 	}
 
-	rspData := &protocol.UpLoadImageResponse{}
+	rspData = &protocol.UpLoadImageResponse{}
 	err = json.Unmarshal(rspBytes, &rspData)
 	if err != nil {
 		return nil, common.ErrJsonUnmarshal.ErrorWithExtErr(err)
 	}
 
 	if rspData.Code != 0 {
+		openAPICode = rspData.Code
 		auth.CheckAndDisableTenantToken(ctx, appID, tenantKey, rspData.Code)
-		return rspData, common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+		recordOpenAPIError(rspData.Code)
+		err = common.ErrOpenApiReturnError.ErrorWithExtStr(fmt.Sprintf("[code:%d msg:%s]", rspData.Code, rspData.Msg))
+		return rspData, err
 	}
 
 	return rspData, nil
-
 }
 
-func GenBinaryImageByPath(path string, imageType protocol.ImageType) (*bytes.Buffer, string, error) {
+// GenBinaryImageByPath streams the file at path through validation and into
+// a multipart request body. The returned reader must be fully drained (e.g.
+// by handing it to UploadImage) for the underlying file to be closed.
+func GenBinaryImageByPath(path string, imageType protocol.ImageType, opts ImageUploadOptions) (io.Reader, string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, "", fmt.Errorf("open file error[%v]", err)
 	}
-	defer file.Close()
 
-	buffer := &bytes.Buffer{}
-	writer := multipart.NewWriter(buffer)
-	imageFile, err := writer.CreateFormFile("image", path)
-	if err != nil {
-		return nil, "", fmt.Errorf("create form file error[%v]", err)
-	}
-	_, err = io.Copy(imageFile, file)
+	body, err := prepareImageReader(file, opts)
 	if err != nil {
-		return nil, "", fmt.Errorf("io copy error[%v]", err)
+		file.Close()
+		return nil, "", err
 	}
 
-	writer.WriteField("image_type", string(imageType))
-	err = writer.Close()
-	if err != nil {
-		return nil, "", fmt.Errorf("writer close error[%v]", err)
-	}
-	contentType := writer.FormDataContentType()
-
-	return buffer, contentType, nil
+	reader, contentType := streamMultipartImage("image", path, string(imageType), body, file.Close)
+	return reader, contentType, nil
 }
 
-func GenBinaryImageByUrl(url string, imageType protocol.ImageType) (*bytes.Buffer, string, error) {
-	imageBytes, err := downloadImage(url)
+// GenBinaryImageByUrl downloads url (respecting opts.MaxBytes/HTTPClient),
+// validates it, and streams it into a multipart request body.
+func GenBinaryImageByUrl(ctx context.Context, url string, imageType protocol.ImageType, opts ImageUploadOptions) (io.Reader, string, error) {
+	imageBytes, err := downloadImage(ctx, url, opts)
 	if err != nil {
 		return nil, "", fmt.Errorf("download image error[%v]", err)
 	}
 
+	body, err := prepareImageReader(bytes.NewReader(imageBytes), opts)
+	if err != nil {
+		return nil, "", err
+	}
+
 	path := strings.Split(url, "/")
 	name := path[0]
 	if len(path) > 1 {
 		name = path[len(path)-1]
 	}
 
-	buffer := &bytes.Buffer{}
-	writer := multipart.NewWriter(buffer)
-	part, err := writer.CreateFormFile("image", name)
-	if err != nil {
-		return nil, "", fmt.Errorf("create form file error[%v]", err)
+	reader, contentType := streamMultipartImage("image", name, string(imageType), body, nil)
+	return reader, contentType, nil
+}
+
+// prepareImageReader enforces opts.MaxBytes, sniffs the Content-Type against
+// allowedImageContentTypes, and optionally normalizes JPEG orientation. It
+// returns a reader positioned at the start of the (possibly re-encoded)
+// image.
+func prepareImageReader(r io.Reader, opts ImageUploadOptions) (io.Reader, error) {
+	limited := &maxBytesReader{r: r, n: opts.maxBytes()}
+
+	sniffBuf := make([]byte, sniffLen)
+	n, err := io.ReadFull(limited, sniffBuf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("read header error[%v]", err)
+	}
+	sniffBuf = sniffBuf[:n]
+
+	contentType := http.DetectContentType(sniffBuf)
+	if !allowedImageContentTypes[contentType] {
+		return nil, common.ErrImageTypeNotAllowed.ErrorWithExtStr(contentType)
 	}
-	_, err = io.Copy(part, bytes.NewReader(imageBytes))
+
+	rest := io.MultiReader(bytes.NewReader(sniffBuf), limited)
+
+	if opts.NormalizeOrientation && contentType == "image/jpeg" {
+		return normalizeJPEGOrientation(rest)
+	}
+
+	return rest, nil
+}
+
+// normalizeJPEGOrientation decodes r as a JPEG, re-orients it per its EXIF
+// orientation tag (values 1-8, see the orientation* constants), and
+// re-encodes it. Images without EXIF data, or with orientation 1, are
+// returned unchanged.
+func normalizeJPEGOrientation(r io.Reader) (io.Reader, error) {
+	raw, err := io.ReadAll(r)
 	if err != nil {
-		return nil, "", fmt.Errorf("io copy error[%v]", err)
+		return nil, fmt.Errorf("read image error[%v]", err)
 	}
 
-	writer.WriteField("image_type", string(imageType))
-	err = writer.Close()
+	orientation := orientationUpright
+	if x, err := exif.Decode(bytes.NewReader(raw)); err == nil {
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			if v, err := tag.Int(0); err == nil {
+				orientation = v
+			}
+		}
+	}
+
+	if orientation == orientationUpright {
+		return bytes.NewReader(raw), nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
 	if err != nil {
-		return nil, "", fmt.Errorf("writer close error[%v]", err)
+		// Not a decodable image (or EXIF lied about orientation); upload as-is.
+		return bytes.NewReader(raw), nil
+	}
+
+	oriented := applyOrientation(img, orientation)
+
+	out := &bytes.Buffer{}
+	if err := jpeg.Encode(out, oriented, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, fmt.Errorf("re-encode image error[%v]", err)
+	}
+
+	return out, nil
+}
+
+// applyOrientation rotates/flips img per the EXIF orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case orientationFlipped:
+		return flipHorizontal(img)
+	case orientationUpsideDown:
+		return rotate180(img)
+	case orientationUpsideDownFlipped:
+		return flipVertical(img)
+	case orientationRotatedCWFlipped:
+		return flipHorizontal(rotate90(img))
+	case orientationRotatedCCW:
+		return rotate90(img)
+	case orientationRotatedCCWFlipped:
+		return flipHorizontal(rotate270(img))
+	case orientationRotatedCW:
+		return rotate270(img)
+	default:
+		return img
+	}
+}
+
+func rotate90(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.Y-1-y, x, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func rotate180(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.X-1-x, b.Max.Y-1-y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func rotate270(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(y, b.Max.X-1-x, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func flipHorizontal(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.X-1-x, y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func flipVertical(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, b.Max.Y-1-y, img.At(x, y))
+		}
 	}
+	return dst
+}
+
+// streamMultipartImage writes content into a multipart/form-data body on a
+// pipe, so the caller can hand the returned reader straight to an HTTP
+// request without buffering the whole payload. cleanup, if non-nil, runs
+// once content has been fully read (or the write fails).
+func streamMultipartImage(fieldName, fileName, imageType string, content io.Reader, cleanup func() error) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
 	contentType := writer.FormDataContentType()
 
-	return buffer, contentType, nil
+	go func() {
+		var err error
+		defer func() {
+			if cleanup != nil {
+				cleanup()
+			}
+			pw.CloseWithError(err)
+		}()
+
+		var part io.Writer
+		part, err = writer.CreateFormFile(fieldName, fileName)
+		if err != nil {
+			return
+		}
+		if _, err = io.Copy(part, content); err != nil {
+			return
+		}
+		if err = writer.WriteField("image_type", imageType); err != nil {
+			return
+		}
+		err = writer.Close()
+	}()
+
+	return pr, contentType
 }
 
-func downloadImage(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// downloadImage fetches url with opts.HTTPClient (or a default, timed-out
+// client), enforcing opts.MaxBytes on the response body.
+func downloadImage(ctx context.Context, url string, opts ImageUploadOptions) (data []byte, err error) {
+	_, endSpan := startSpan(ctx, "message.downloadImage")
+	defer func() { endSpan(err) }()
+
+	resp, err := opts.httpClient().Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("http get error[%v]", err)
 	}
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+
+	limited := &maxBytesReader{r: resp.Body, n: opts.maxBytes()}
+	data, err = io.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-func addLruCache(key string, value interface{}) {
-	if value != "" {
-		LruCache.Add(key, value)
+// maxBytesReader errors with common.ErrImageTooLarge once more than n bytes
+// have been read, instead of silently truncating like io.LimitReader.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, common.ErrImageTooLarge.Error()
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, common.ErrImageTooLarge.Error()
 	}
+	return n, err
 }
@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testOrientationImage returns a w x h RGBA image with a distinct color per
+// pixel (R=x, G=y), so any rotation/mirror bug shows up as a pixel-position
+// mismatch rather than a uniform color staying accidentally "correct".
+func testOrientationImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0, A: 255})
+		}
+	}
+	return img
+}
+
+// expectedOrientationPixel maps a stored pixel at (x, y) in a w x h image to
+// its (newX, newY) position after correcting for orientation, per the EXIF
+// orientation spec (independent of applyOrientation's own rotate/flip
+// helpers, so this can't just mirror the same bug back).
+func expectedOrientationPixel(orientation, x, y, w, h int) (newX, newY int) {
+	switch orientation {
+	case orientationUpright:
+		return x, y
+	case orientationFlipped:
+		return w - 1 - x, y
+	case orientationUpsideDown:
+		return w - 1 - x, h - 1 - y
+	case orientationUpsideDownFlipped:
+		return x, h - 1 - y
+	case orientationRotatedCWFlipped: // 5: transpose
+		return y, x
+	case orientationRotatedCCW: // 6: rotate 90 CW
+		return h - 1 - y, x
+	case orientationRotatedCCWFlipped: // 7: transverse
+		return h - 1 - y, w - 1 - x
+	case orientationRotatedCW: // 8: rotate 90 CCW
+		return y, w - 1 - x
+	default:
+		return x, y
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	const w, h = 3, 2 // asymmetric dimensions catch width/height swap bugs
+
+	orientations := []int{
+		orientationUpright,
+		orientationFlipped,
+		orientationUpsideDown,
+		orientationUpsideDownFlipped,
+		orientationRotatedCW,
+		orientationRotatedCCWFlipped,
+		orientationRotatedCCW,
+		orientationRotatedCWFlipped,
+	}
+
+	for _, orientation := range orientations {
+		src := testOrientationImage(w, h)
+		got := applyOrientation(src, orientation)
+
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				wantX, wantY := expectedOrientationPixel(orientation, x, y, w, h)
+				wantColor := src.At(x, y)
+				gotColor := got.At(wantX, wantY)
+				if gotColor != wantColor {
+					t.Errorf("orientation %d: pixel (%d,%d) -> (%d,%d): got %v, want %v",
+						orientation, x, y, wantX, wantY, gotColor, wantColor)
+				}
+			}
+		}
+	}
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		input   string
+		wantErr bool
+	}{
+		{name: "under limit", limit: 5, input: "abc", wantErr: false},
+		{name: "exactly at limit", limit: 5, input: "abcde", wantErr: false},
+		{name: "one byte over limit", limit: 5, input: "abcdef", wantErr: true},
+		{name: "zero limit, empty input", limit: 0, input: "", wantErr: false},
+		{name: "zero limit, nonempty input", limit: 0, input: "a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &maxBytesReader{r: strings.NewReader(tt.input), n: tt.limit}
+			data, err := io.ReadAll(r)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error reading past limit %d, got data %q", tt.limit, data)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(data, []byte(tt.input)) {
+				t.Fatalf("got %q, want %q", data, tt.input)
+			}
+		})
+	}
+}
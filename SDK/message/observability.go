@@ -0,0 +1,162 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracerMu sync.RWMutex
+	tracer   trace.Tracer
+)
+
+// SetTracer installs the OpenTelemetry tracer used to instrument
+// GetImageKey, UploadImage, GetImageBinData and downloadImage. A nil
+// tracer (the default) disables span creation, so this is safe to leave
+// unset.
+//
+// KNOWN GAP: these spans end at the SDK boundary. common.DoHttp/
+// DoHttpGetOApi (vendored outside this package, not touched here) take no
+// context.Context and don't propagate trace headers onto the outbound
+// request, so the Lark open-platform call itself is not part of the trace.
+// Closing that gap requires changing the common package's DoHttp* signatures
+// to accept and forward ctx.
+func SetTracer(t trace.Tracer) {
+	tracerMu.Lock()
+	tracer = t
+	tracerMu.Unlock()
+}
+
+func getTracer() trace.Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return tracer
+}
+
+// startSpan starts a span named name on the package tracer, returning the
+// derived context and a function that must be called with the operation's
+// error (nil on success) and any attributes only known at completion time
+// (e.g. cache_hit, bytes_uploaded) to end it. It's a no-op until SetTracer
+// is called.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(err error, endAttrs ...attribute.KeyValue)) {
+	t := getTracer()
+	if t == nil {
+		return ctx, func(error, ...attribute.KeyValue) {}
+	}
+
+	ctx, span := t.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, func(err error, endAttrs ...attribute.KeyValue) {
+		if len(endAttrs) > 0 {
+			span.SetAttributes(endAttrs...)
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
+
+// metrics bundles the package's Prometheus collectors. Nil until
+// RegisterMetrics is called.
+type metrics struct {
+	uploadBytes    prometheus.Counter
+	uploadDuration prometheus.Histogram
+	cacheHits      prometheus.Counter
+	openAPIErrors  *prometheus.CounterVec
+}
+
+var (
+	metricsMu      sync.RWMutex
+	packageMetrics *metrics
+)
+
+// RegisterMetrics registers the package's Prometheus collectors -
+// botframework_upload_bytes_total, botframework_upload_duration_seconds,
+// botframework_cache_hits_total and botframework_openapi_errors_total
+// (labeled by "code") - on reg. Call it once during startup; until it's
+// called, metrics recording is a no-op.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	m := &metrics{
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "botframework_upload_bytes_total",
+			Help: "Total bytes uploaded via UploadImage.",
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "botframework_upload_duration_seconds",
+			Help: "Duration of UploadImage calls, in seconds.",
+		}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "botframework_cache_hits_total",
+			Help: "Total image key cache hits in GetImageKey.",
+		}),
+		openAPIErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "botframework_openapi_errors_total",
+			Help: "Total open-platform API error responses, by code.",
+		}, []string{"code"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.uploadBytes, m.uploadDuration, m.cacheHits, m.openAPIErrors} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	metricsMu.Lock()
+	packageMetrics = m
+	metricsMu.Unlock()
+
+	return nil
+}
+
+func getMetrics() *metrics {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return packageMetrics
+}
+
+func recordCacheHit() {
+	if m := getMetrics(); m != nil {
+		m.cacheHits.Inc()
+	}
+}
+
+func recordUpload(duration time.Duration, bytesUploaded int64) {
+	m := getMetrics()
+	if m == nil {
+		return
+	}
+	m.uploadDuration.Observe(duration.Seconds())
+	if bytesUploaded > 0 {
+		m.uploadBytes.Add(float64(bytesUploaded))
+	}
+}
+
+func recordOpenAPIError(code int) {
+	if m := getMetrics(); m != nil {
+		m.openAPIErrors.WithLabelValues(strconv.Itoa(code)).Inc()
+	}
+}
+
+// byteCountingReader wraps an io.Reader, tallying bytes read so callers can
+// report bytes_uploaded without the underlying transport exposing it.
+type byteCountingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *byteCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
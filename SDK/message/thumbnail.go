@@ -0,0 +1,157 @@
+// Copyright (c) 2019 Bytedance Inc.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif" // register gif with image.Decode, for thumbnailing gif uploads
+	"image/jpeg"
+	"image/png"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/larksuite/botframework-go/SDK/protocol"
+)
+
+// defaultThumbnailQuality is used when ThumbnailSpec.Quality is unset.
+const defaultThumbnailQuality = 85
+
+// ThumbnailSpec describes one resized variant GetImageKey should produce
+// alongside the original upload.
+type ThumbnailSpec struct {
+	// Name identifies this variant in MultiImageKeys.Thumbnails, e.g.
+	// "small" or "card_preview".
+	Name string
+
+	// Width/Height are the target box passed to imaging.Resize; a zero
+	// value preserves the aspect ratio for that dimension.
+	Width  int
+	Height int
+
+	// Quality is the JPEG encode quality (1-100). Zero means
+	// defaultThumbnailQuality. Unused for Format "png".
+	Quality int
+
+	// Format is "jpeg" (default) or "png".
+	Format string
+}
+
+func (s ThumbnailSpec) quality() int {
+	if s.Quality > 0 {
+		return s.Quality
+	}
+	return defaultThumbnailQuality
+}
+
+func (s ThumbnailSpec) format() string {
+	if s.Format != "" {
+		return s.Format
+	}
+	return "jpeg"
+}
+
+// MultiImageKeys is returned by GetImageKey. Thumbnails is nil unless
+// ImageUploadOptions.GenerateThumbnails was set.
+type MultiImageKeys struct {
+	ImageKey   string
+	Thumbnails map[string]string
+}
+
+// generateThumbnails decodes raw once and produces a resized, re-encoded
+// variant per spec using Lanczos resampling (github.com/disintegration/
+// imaging). Each variant is uploaded and cached under
+// originalCacheKey+":"+spec.Name, so repeated uploads of the same original
+// dedupe their thumbnails too.
+//
+// Thumbnailing is best-effort: the original image has already uploaded
+// successfully by the time this runs, so a failure decoding raw (e.g. a
+// webp, for which no decoder is registered) or resizing/uploading any one
+// spec is skipped rather than failing the call and losing the other
+// variants, or the original, along with it.
+func generateThumbnails(ctx context.Context, tenantKey, appID string, raw []byte, specs []ThumbnailSpec, originalCacheKey string) (map[string]string, error) {
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil
+	}
+
+	cache := getImageKeyCache()
+	thumbnails := make(map[string]string, len(specs))
+
+	for _, spec := range specs {
+		variantCacheKey := thumbnailCacheKey(originalCacheKey, spec.Name)
+
+		if imageKey, ok, err := cache.Get(ctx, variantCacheKey); err == nil && ok && imageKey != "" {
+			thumbnails[spec.Name] = imageKey
+			continue
+		}
+
+		resized := imaging.Resize(img, spec.Width, spec.Height, imaging.Lanczos)
+
+		encoded, err := encodeThumbnail(resized, spec)
+		if err != nil {
+			continue
+		}
+
+		name := fmt.Sprintf("%s_%s", originalCacheKey, spec.Name)
+		body, contentType := streamMultipartImage("image", name, string(protocol.MessageImageType), bytes.NewReader(encoded), nil)
+
+		rspData, err := UploadImage(ctx, tenantKey, appID, body, contentType)
+		if err != nil {
+			continue
+		}
+
+		cache.Set(ctx, variantCacheKey, rspData.Data.ImageKey, defaultImageKeyCacheTTL)
+		thumbnails[spec.Name] = rspData.Data.ImageKey
+	}
+
+	return thumbnails, nil
+}
+
+// lookupCachedThumbnails returns the previously-cached imageKey for every
+// spec in specs, keyed by originalCacheKey, without touching the network.
+// complete is false if any spec isn't cached yet, in which case thumbnails
+// is nil and the caller should regenerate the full set instead of using a
+// partial result.
+func lookupCachedThumbnails(ctx context.Context, originalCacheKey string, specs []ThumbnailSpec) (thumbnails map[string]string, complete bool) {
+	if len(specs) == 0 {
+		return nil, true
+	}
+
+	cache := getImageKeyCache()
+	thumbnails = make(map[string]string, len(specs))
+
+	for _, spec := range specs {
+		imageKey, ok, err := cache.Get(ctx, thumbnailCacheKey(originalCacheKey, spec.Name))
+		if err != nil || !ok || imageKey == "" {
+			return nil, false
+		}
+		thumbnails[spec.Name] = imageKey
+	}
+
+	return thumbnails, true
+}
+
+func thumbnailCacheKey(originalCacheKey, specName string) string {
+	return originalCacheKey + ":" + specName
+}
+
+func encodeThumbnail(img image.Image, spec ThumbnailSpec) ([]byte, error) {
+	out := &bytes.Buffer{}
+
+	if spec.format() == "png" {
+		if err := png.Encode(out, img); err != nil {
+			return nil, fmt.Errorf("encode thumbnail error[%v]", err)
+		}
+		return out.Bytes(), nil
+	}
+
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: spec.quality()}); err != nil {
+		return nil, fmt.Errorf("encode thumbnail error[%v]", err)
+	}
+	return out.Bytes(), nil
+}